@@ -1,21 +1,83 @@
 package logger
 
 import (
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 )
 
-// Interface provides the minimal logging interface
+// Interface provides the structured logging methods used throughout this
+// module. Each level method accepts a message followed by an even number of
+// key/value arguments, in the same style as log/slog's logging methods.
 type Interface interface {
-	// Logf prints to the logger using the format.
-	Printf(format string, v ...interface{})
-	// Log prints to the logger.
-	Print(v ...interface{})
-	// Fatal is equivalent to Print() followed by a call to os.Exit(1).
-	Fatal(v ...interface{})
-	// Fatalf is equivalent to Printf() followed by a call to os.Exit(1).
-	Fatalf(format string, v ...interface{})
-}
-
-// DefaultLogger logs messages to os.Stdout
-var DefaultLogger = log.New(os.Stdout, "", log.LstdFlags)
+	// Debug logs a low-level diagnostic event.
+	Debug(msg string, args ...interface{})
+	// Info logs a routine event.
+	Info(msg string, args ...interface{})
+	// Warn logs an event that is recoverable but noteworthy.
+	Warn(msg string, args ...interface{})
+	// Error logs an event describing a failure.
+	Error(msg string, args ...interface{})
+	// With returns a logger that attaches args to every record it emits,
+	// useful for deriving a request- or session-scoped logger.
+	With(args ...interface{}) Interface
+}
+
+// slogLogger adapts a *slog.Logger to Interface.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// New returns an Interface backed by slog.New(handler).
+func New(handler slog.Handler) Interface {
+	return &slogLogger{l: slog.New(handler)}
+}
+
+func (s *slogLogger) Debug(msg string, args ...interface{}) { s.l.Debug(msg, args...) }
+func (s *slogLogger) Info(msg string, args ...interface{})  { s.l.Info(msg, args...) }
+func (s *slogLogger) Warn(msg string, args ...interface{})  { s.l.Warn(msg, args...) }
+func (s *slogLogger) Error(msg string, args ...interface{}) { s.l.Error(msg, args...) }
+func (s *slogLogger) With(args ...interface{}) Interface {
+	return &slogLogger{l: s.l.With(args...)}
+}
+
+// DefaultLogger logs structured events as JSON to os.Stdout.
+var DefaultLogger Interface = New(slog.NewJSONHandler(os.Stdout, nil))
+
+// stdLogger adapts a pre-existing *log.Logger to Interface, for callers who
+// configured a standard-library logger before this package moved to slog and
+// don't want to switch destinations or formats.
+type stdLogger struct {
+	l     *log.Logger
+	attrs []interface{}
+}
+
+// NewStdLogger wraps l so that it satisfies Interface. Each record is
+// rendered as "LEVEL msg key=value ...", written through l, so the
+// destination and flags already configured on l are preserved.
+func NewStdLogger(l *log.Logger) Interface {
+	return &stdLogger{l: l}
+}
+
+func (s *stdLogger) Debug(msg string, args ...interface{}) { s.print("DEBUG", msg, args) }
+func (s *stdLogger) Info(msg string, args ...interface{})  { s.print("INFO", msg, args) }
+func (s *stdLogger) Warn(msg string, args ...interface{})  { s.print("WARN", msg, args) }
+func (s *stdLogger) Error(msg string, args ...interface{}) { s.print("ERROR", msg, args) }
+
+func (s *stdLogger) With(args ...interface{}) Interface {
+	attrs := make([]interface{}, 0, len(s.attrs)+len(args))
+	attrs = append(attrs, s.attrs...)
+	attrs = append(attrs, args...)
+	return &stdLogger{l: s.l, attrs: attrs}
+}
+
+func (s *stdLogger) print(level, msg string, args []interface{}) {
+	line := fmt.Sprintf("%s %s", level, msg)
+	for _, pairs := range [][]interface{}{s.attrs, args} {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			line += fmt.Sprintf(" %v=%v", pairs[i], pairs[i+1])
+		}
+	}
+	s.l.Print(line)
+}
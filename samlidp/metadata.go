@@ -0,0 +1,249 @@
+package samlidp
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/vine-io/saml"
+)
+
+// MetadataSource lets a Service be registered by URL instead of by pasting
+// its XML metadata into HandlePutService. metadataRefresher fetches, verifies
+// and periodically re-fetches the document; GetServiceProvider additionally
+// consults MDQBaseURL, if set, to resolve SPs that were never registered at
+// all.
+type MetadataSource struct {
+	// URL is the metadata endpoint to fetch, serving either a single
+	// EntityDescriptor or an EntitiesDescriptor. Leave empty when only
+	// MDQBaseURL is wanted.
+	URL string `json:",omitempty"`
+
+	// RefreshInterval controls how often URL is re-fetched. Zero disables
+	// periodic refresh of this service.
+	RefreshInterval time.Duration `json:",omitempty"`
+
+	// TrustedSigningCerts pins the PEM-encoded certificates the document's
+	// enveloped XML-DSig signature must be made by. When the list is
+	// non-empty, a document that is unsigned, or signed by a certificate not
+	// in this list, is rejected. When it is empty, fetches of URL do not
+	// check the signature at all, and MDQ lookups are refused.
+	TrustedSigningCerts []string `json:",omitempty"`
+
+	// MDQBaseURL, if set, is used by GetServiceProvider to resolve an SP
+	// entity ID that isn't otherwise registered, per the Metadata Query
+	// Protocol (https://datatracker.ietf.org/doc/html/draft-young-md-query).
+	MDQBaseURL string `json:",omitempty"`
+}
+
+// mdqCacheEntry is either a resolved EntityDescriptor (Err == nil) or a
+// negative-cache record of a lookup that failed, both valid until Expiry.
+type mdqCacheEntry struct {
+	Descriptor *saml.EntityDescriptor
+	Err        error
+	Expiry     time.Time
+}
+
+// mdqNegativeCacheTTL bounds how long GetServiceProvider will keep returning
+// os.ErrNotExist for an entity ID without re-querying the MDQ endpoint.
+const mdqNegativeCacheTTL = 5 * time.Minute
+
+// metadataRefresher periodically re-fetches the metadata of every Service
+// that has a MetadataSource with a non-zero RefreshInterval, verifying and
+// swapping it into s.serviceProviders on success. It is started from New in
+// its own goroutine and runs until ctx is canceled.
+func (s *Server) metadataRefresher(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshDueServices(ctx)
+		}
+	}
+}
+
+// refreshDueServices re-fetches every Service whose MetadataSource is due for
+// a refresh, recording the outcome on the Service so operators can inspect it
+// via GET /services/:id.
+func (s *Server) refreshDueServices(ctx context.Context) {
+	names, err := s.Store.List(ctx, "/services/")
+	if err != nil {
+		s.logger.Error("failed to list services for metadata refresh", "err", err)
+		return
+	}
+
+	for _, name := range names {
+		key := fmt.Sprintf("/services/%s", name)
+		service := Service{}
+		if err := s.Store.Get(ctx, key, &service); err != nil {
+			s.logger.Error("failed to get service for metadata refresh", "err", err, "sp_entity_id", name)
+			continue
+		}
+		source := service.MetadataSource
+		if source == nil || source.URL == "" || source.RefreshInterval <= 0 {
+			continue
+		}
+		if time.Since(service.LastRefreshed) < source.RefreshInterval {
+			continue
+		}
+
+		descriptor, err := fetchAndVerifyMetadata(ctx, source)
+		service.LastRefreshed = timeNow()
+		if err != nil {
+			service.LastRefreshError = err.Error()
+			s.logger.Warn("failed to refresh service metadata", "err", err, "sp_entity_id", service.Metadata.EntityID, "url", source.URL)
+			if putErr := s.Store.Put(ctx, key, &service); putErr != nil {
+				s.logger.Error("failed to persist metadata refresh failure", "err", putErr, "sp_entity_id", service.Metadata.EntityID)
+			}
+			continue
+		}
+
+		service.LastRefreshError = ""
+		service.Metadata = *descriptor
+		if err := s.Store.Put(ctx, key, &service); err != nil {
+			s.logger.Error("failed to persist refreshed service metadata", "err", err, "sp_entity_id", service.Metadata.EntityID)
+			continue
+		}
+
+		s.idpConfigMu.Lock()
+		s.serviceProviders[service.Metadata.EntityID] = &service.Metadata
+		s.idpConfigMu.Unlock()
+	}
+}
+
+// fetchAndVerifyMetadata fetches source.URL, verifies its enveloped XML-DSig
+// signature against source.TrustedSigningCerts (skipping the check when that
+// list is empty), rejects it if ValidUntil has
+// passed, and returns the EntityDescriptor it describes. If the document is
+// an EntitiesDescriptor, the first EntityDescriptor is returned.
+func fetchAndVerifyMetadata(ctx context.Context, source *MetadataSource) (*saml.EntityDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("samlidp: %s returned %s", source.URL, resp.Status)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(source.TrustedSigningCerts) > 0 {
+		if err := verifyMetadataSignature(raw, source.TrustedSigningCerts); err != nil {
+			return nil, err
+		}
+	}
+
+	descriptor, err := parseEntityDescriptor(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !descriptor.ValidUntil.IsZero() && descriptor.ValidUntil.Before(timeNow()) {
+		return nil, fmt.Errorf("samlidp: metadata for %s expired at %s", descriptor.EntityID, descriptor.ValidUntil)
+	}
+	return descriptor, nil
+}
+
+// parseEntityDescriptor accepts either a single EntityDescriptor document or
+// an EntitiesDescriptor one, returning the first EntityDescriptor found.
+func parseEntityDescriptor(raw []byte) (*saml.EntityDescriptor, error) {
+	entities := saml.EntitiesDescriptor{}
+	if err := xml.Unmarshal(raw, &entities); err == nil && len(entities.EntityDescriptors) > 0 {
+		return &entities.EntityDescriptors[0], nil
+	}
+
+	descriptor := saml.EntityDescriptor{}
+	if err := xml.Unmarshal(raw, &descriptor); err != nil {
+		return nil, err
+	}
+	if descriptor.EntityID == "" {
+		return nil, fmt.Errorf("samlidp: document has no EntityDescriptor")
+	}
+	return &descriptor, nil
+}
+
+// verifyMetadataSignature checks that raw carries a valid enveloped XML-DSig
+// signature made by one of certs.
+func verifyMetadataSignature(raw []byte, certs []string) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return err
+	}
+
+	store := dsig.MemoryX509CertificateStore{}
+	for _, certPEM := range certs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return fmt.Errorf("samlidp: invalid PEM in TrustedSigningCerts")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		store.Roots = append(store.Roots, cert)
+	}
+
+	validator := dsig.NewDefaultValidationContext(&store)
+	_, err := validator.Validate(doc.Root())
+	return err
+}
+
+// lookupMDQ resolves entityID against baseURL per the Metadata Query
+// Protocol, caching both successful and failed lookups in s.mdqCache for
+// mdqNegativeCacheTTL so a misconfigured SP doesn't cause a lookup on every
+// request. trustedCerts pins the signature the resolved document must carry;
+// an MDQ endpoint is reachable by anyone who can make a DNS lookup resolve,
+// so without a pinned signer an attacker could spoof a descriptor and have
+// the IDP hand assertions to whatever ACS URL it names. lookupMDQ therefore
+// refuses to resolve anything when trustedCerts is empty, rather than
+// silently trusting an unsigned or arbitrarily-signed document.
+func (s *Server) lookupMDQ(ctx context.Context, baseURL string, trustedCerts []string, entityID string) (*saml.EntityDescriptor, error) {
+	sum := sha1.Sum([]byte(entityID))
+	location := fmt.Sprintf("%s/entities/%s", baseURL, hex.EncodeToString(sum[:]))
+
+	s.mdqMu.Lock()
+	if entry, ok := s.mdqCache[entityID]; ok && timeNow().Before(entry.Expiry) {
+		s.mdqMu.Unlock()
+		return entry.Descriptor, entry.Err
+	}
+	s.mdqMu.Unlock()
+
+	var descriptor *saml.EntityDescriptor
+	var err error
+	if len(trustedCerts) == 0 {
+		err = fmt.Errorf("samlidp: refusing MDQ lookup for %s: no TrustedSigningCerts configured", entityID)
+	} else {
+		descriptor, err = fetchAndVerifyMetadata(ctx, &MetadataSource{URL: location, TrustedSigningCerts: trustedCerts})
+	}
+
+	s.mdqMu.Lock()
+	if s.mdqCache == nil {
+		s.mdqCache = map[string]mdqCacheEntry{}
+	}
+	s.mdqCache[entityID] = mdqCacheEntry{Descriptor: descriptor, Err: err, Expiry: timeNow().Add(mdqNegativeCacheTTL)}
+	s.mdqMu.Unlock()
+
+	if err != nil {
+		s.logger.Warn("failed to resolve service provider via MDQ", "err", err, "sp_entity_id", entityID, "mdq_base_url", baseURL)
+	}
+	return descriptor, err
+}
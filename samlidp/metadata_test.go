@@ -0,0 +1,152 @@
+package samlidp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	"github.com/vine-io/saml/logger"
+)
+
+// metadataSigningCert generates a throwaway self-signed RSA certificate and
+// key pair, returning the certificate both parsed and PEM-encoded the way
+// MetadataSource.TrustedSigningCerts expects it.
+func metadataSigningCert(t *testing.T) (crypto.Signer, *x509.Certificate, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "samlidp-metadata-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %s", err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return key, cert, certPEM
+}
+
+// signedEntityDescriptor returns an enveloped-XML-DSig-signed EntityDescriptor
+// document for entityID, signed with key/cert.
+func signedEntityDescriptor(t *testing.T, key crypto.Signer, cert *x509.Certificate, entityID string) []byte {
+	t.Helper()
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" ID="_samlidp-metadata-test" entityID="` + entityID + `"></EntityDescriptor>`); err != nil {
+		t.Fatalf("ReadFromString: %s", err)
+	}
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore{PrivateKey: key, Certificate: cert})
+	signed, err := ctx.SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatalf("SignEnveloped: %s", err)
+	}
+	doc.SetRoot(signed)
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("WriteToBytes: %s", err)
+	}
+	return raw
+}
+
+func TestVerifyMetadataSignature(t *testing.T) {
+	key, cert, certPEM := metadataSigningCert(t)
+	raw := signedEntityDescriptor(t, key, cert, "https://sp.example.com/metadata")
+
+	t.Run("valid signature is accepted", func(t *testing.T) {
+		if err := verifyMetadataSignature(raw, []string{certPEM}); err != nil {
+			t.Fatalf("verifyMetadataSignature: %s", err)
+		}
+	})
+
+	t.Run("tampered document is rejected", func(t *testing.T) {
+		tampered := strings.Replace(string(raw), "sp.example.com", "evil.example.com", 1)
+		if err := verifyMetadataSignature([]byte(tampered), []string{certPEM}); err == nil {
+			t.Fatal("verifyMetadataSignature accepted a tampered document")
+		}
+	})
+
+	t.Run("untrusted certificate is rejected", func(t *testing.T) {
+		_, _, otherCertPEM := metadataSigningCert(t)
+		if err := verifyMetadataSignature(raw, []string{otherCertPEM}); err == nil {
+			t.Fatal("verifyMetadataSignature accepted a signature from an untrusted certificate")
+		}
+	})
+
+	t.Run("invalid PEM is rejected", func(t *testing.T) {
+		if err := verifyMetadataSignature(raw, []string{"not a pem block"}); err == nil {
+			t.Fatal("verifyMetadataSignature accepted invalid PEM in TrustedSigningCerts")
+		}
+	})
+}
+
+func TestFetchAndVerifyMetadata(t *testing.T) {
+	key, cert, certPEM := metadataSigningCert(t)
+	raw := signedEntityDescriptor(t, key, cert, "https://sp.example.com/metadata")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(raw)
+	}))
+	defer ts.Close()
+
+	t.Run("verified fetch succeeds and parses the descriptor", func(t *testing.T) {
+		descriptor, err := fetchAndVerifyMetadata(context.Background(), &MetadataSource{URL: ts.URL, TrustedSigningCerts: []string{certPEM}})
+		if err != nil {
+			t.Fatalf("fetchAndVerifyMetadata: %s", err)
+		}
+		if descriptor.EntityID != "https://sp.example.com/metadata" {
+			t.Fatalf("EntityID = %q, want %q", descriptor.EntityID, "https://sp.example.com/metadata")
+		}
+	})
+
+	t.Run("untrusted certificate is rejected", func(t *testing.T) {
+		_, _, otherCertPEM := metadataSigningCert(t)
+		if _, err := fetchAndVerifyMetadata(context.Background(), &MetadataSource{URL: ts.URL, TrustedSigningCerts: []string{otherCertPEM}}); err == nil {
+			t.Fatal("fetchAndVerifyMetadata accepted a document signed by an untrusted certificate")
+		}
+	})
+}
+
+func TestLookupMDQRefusesWithoutTrustedCerts(t *testing.T) {
+	s := &Server{logger: logger.New(slog.NewTextHandler(io.Discard, nil))}
+
+	descriptor, err := s.lookupMDQ(context.Background(), "https://mdq.example.com", nil, "https://sp.example.com/metadata")
+	if err == nil {
+		t.Fatal("lookupMDQ resolved an entity with no TrustedSigningCerts configured")
+	}
+	if descriptor != nil {
+		t.Fatalf("lookupMDQ returned a descriptor alongside an error: %v", descriptor)
+	}
+
+	s.mdqMu.Lock()
+	entry, ok := s.mdqCache["https://sp.example.com/metadata"]
+	s.mdqMu.Unlock()
+	if !ok {
+		t.Fatal("lookupMDQ did not cache the refused lookup")
+	}
+	if entry.Err == nil {
+		t.Fatal("cached entry for a refused lookup has no error")
+	}
+}
@@ -3,11 +3,13 @@
 package samlidp
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -22,25 +24,82 @@ type Options struct {
 	Logger      logger.Interface
 	Certificate *x509.Certificate
 	Store       Store
+
+	// DefaultSessionLifetime bounds how long a session is honored from
+	// creation, for any User that doesn't set its own SessionLifetime. Zero
+	// means sessions never expire outright.
+	DefaultSessionLifetime time.Duration
+
+	// DefaultIdleTimeout bounds how long a session may go without being used
+	// to satisfy an authentication request, for any User that doesn't set
+	// its own IdleTimeout. Zero means sessions never go idle.
+	DefaultIdleTimeout time.Duration
 }
 
 // Server represents an IDP server. The server provides the following URLs:
 //
-//     /metadata     - the SAML metadata
-//     /sso          - the SAML endpoint to initiate an authentication flow
-//     /login        - prompt for a username and password if no session established
-//     /login/:shortcut - kick off an IDP-initiated authentication flow
-//     /services     - RESTful interface to Service objects
-//     /users        - RESTful interface to User objects
-//     /sessions     - RESTful interface to Session objects
-//     /shortcuts    - RESTful interface to Shortcut objects
+//	/metadata     - the SAML metadata
+//	/sso          - the SAML endpoint to initiate an authentication flow
+//	/slo          - the SAML endpoint for SP-initiated single logout
+//	/login        - prompt for a username and password if no session established
+//	/login/:shortcut - kick off an IDP-initiated authentication flow
+//	/logout       - terminate the caller's session and notify participating SPs
+//	/logout/:shortcut - IDP-initiated logout, then return to the named service
+//	/services     - RESTful interface to Service objects
+//	/users        - RESTful interface to User objects
+//	/sessions     - RESTful interface to Session objects
+//	/sessions/:id/revoke - revoke a session and notify participating SPs
+//	/shortcuts    - RESTful interface to Shortcut objects
 type Server struct {
 	http.Handler
-	idpConfigMu      sync.RWMutex // protects calls into the IDP
-	logger           logger.Interface
-	serviceProviders map[string]*saml.EntityDescriptor
-	IDP              saml.IdentityProvider // the underlying IDP
-	Store            Store                 // the data store
+	idpConfigMu            sync.RWMutex // protects calls into the IDP
+	logger                 logger.Interface
+	serviceProviders       map[string]*saml.EntityDescriptor
+	mdqBaseURL             string   // MDQ endpoint to fall back to, from some Service's MetadataSource; protected by idpConfigMu
+	mdqTrustedCerts        []string // TrustedSigningCerts paired with mdqBaseURL; protected by idpConfigMu
+	mdqMu                  sync.Mutex
+	mdqCache               map[string]mdqCacheEntry // protected by mdqMu
+	defaultSessionLifetime time.Duration
+	defaultIdleTimeout     time.Duration
+	IDP                    saml.IdentityProvider // the underlying IDP
+	Store                  Store                 // the data store
+}
+
+// loggerContextKey is the gin context key under which requestLogger stashes
+// the per-request logger.
+const loggerContextKey = "samlidp.logger"
+
+// loggerFrom returns the request-scoped logger set by requestLogger, or the
+// server's default logger if called outside of a request (or from a handler
+// invoked directly, as in tests).
+func (s *Server) loggerFrom(ctx *gin.Context) logger.Interface {
+	if v, ok := ctx.Get(loggerContextKey); ok {
+		if l, ok := v.(logger.Interface); ok {
+			return l
+		}
+	}
+	return s.logger
+}
+
+// requestLogger returns gin middleware that derives a per-request logger
+// carrying the request's method, path, remote address and a generated
+// request ID, and stores it in the context under loggerContextKey so
+// handlers can fetch it via loggerFrom instead of reaching for s.logger.
+func (s *Server) requestLogger() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestID, err := randomID()
+		if err != nil {
+			requestID = ""
+		}
+		l := s.logger.With(
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"remote_addr", ctx.Request.RemoteAddr,
+			"request_id", requestID,
+		)
+		ctx.Set(loggerContextKey, l)
+		ctx.Next()
+	}
 }
 
 // New returns a new Server
@@ -63,8 +122,10 @@ func New(opts Options) (*Server, error) {
 			MetadataURL: metadataURL,
 			SSOURL:      ssoURL,
 		},
-		logger: logr,
-		Store:  opts.Store,
+		logger:                 logr,
+		Store:                  opts.Store,
+		defaultSessionLifetime: opts.DefaultSessionLifetime,
+		defaultIdleTimeout:     opts.DefaultIdleTimeout,
 	}
 
 	s.IDP.SessionProvider = s
@@ -73,6 +134,9 @@ func New(opts Options) (*Server, error) {
 	if err := s.initializeServices(); err != nil {
 		return nil, err
 	}
+	go s.watchServices(context.Background())
+	go s.metadataRefresher(context.Background())
+	go s.sessionJanitor(context.Background())
 	s.InitializeHTTP()
 	return s, nil
 }
@@ -84,21 +148,23 @@ func (s *Server) InitializeHTTP() {
 	mux := gin.New()
 	s.Handler = mux
 
-	mux.Any("/metadata", func(ctx *gin.Context) {
-		s.idpConfigMu.RLock()
-		defer s.idpConfigMu.RUnlock()
-		s.IDP.ServeMetadata(ctx.Writer, ctx.Request)
-	})
+	mux.Use(s.requestLogger())
+
+	mux.Any("/metadata", s.HandleMetadata)
 	mux.Any("/sso", func(ctx *gin.Context) {
 		s.idpConfigMu.RLock()
 		defer s.idpConfigMu.RUnlock()
 		s.IDP.ServeSSO(ctx.Writer, ctx.Request)
 	})
+	mux.Any("/slo", s.HandleSLO)
 
 	mux.Any("/login", s.HandleLogin)
 	mux.Any("/login/:shortcut", s.HandleIDPInitiated)
 	mux.POST("/login/:shortcut/:state", s.HandleIDPInitiated)
 
+	mux.Any("/logout", s.HandleLogout)
+	mux.Any("/logout/:shortcut", s.HandleLogout)
+
 	mux.GET("/services/", s.HandleListServices)
 	mux.GET("/services/:id", s.HandleGetService)
 	mux.PATCH("/services/:id", s.HandlePutService)
@@ -113,6 +179,7 @@ func (s *Server) InitializeHTTP() {
 	mux.GET("/sessions/", s.HandleListSessions)
 	mux.GET("/sessions/:id", s.HandleGetSession)
 	mux.DELETE("/sessions/:id", s.HandleDeleteSession)
+	mux.POST("/sessions/:id/revoke", s.HandleRevokeSession)
 
 	mux.GET("/shortcuts/", s.HandleListShortcuts)
 	mux.GET("/shortcuts/:id", s.HandleGetShortcut)
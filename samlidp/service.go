@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vine-io/saml"
@@ -19,20 +21,46 @@ type Service struct {
 
 	// Metdata is the XML metadata of the service provider.
 	Metadata saml.EntityDescriptor
+
+	// MetadataSource, if set, lets metadataRefresher keep Metadata in sync
+	// with a remote document instead of requiring it to be pasted in via
+	// HandlePutService.
+	MetadataSource *MetadataSource `json:",omitempty"`
+
+	// LastRefreshed is when MetadataSource.URL was last fetched: set by
+	// HandlePutService on registration, and by metadataRefresher on every
+	// attempt regardless of outcome.
+	LastRefreshed time.Time `json:",omitempty"`
+
+	// LastRefreshError is the error from the most recent refresh attempt, or
+	// "" if it succeeded (or no refresh has happened yet).
+	LastRefreshError string `json:",omitempty"`
 }
 
 // GetServiceProvider returns the Service Provider metadata for the
 // service provider ID, which is typically the service provider's
-// metadata URL. If an appropriate service provider cannot be found then
-// the returned error must be os.ErrNotExist.
+// metadata URL. If serviceProviderID isn't registered and an MDQ base URL
+// has been configured on some Service's MetadataSource, it is resolved via
+// lookupMDQ instead. If an appropriate service provider still cannot be
+// found then the returned error must be os.ErrNotExist.
 func (s *Server) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
 	s.idpConfigMu.RLock()
-	defer s.idpConfigMu.RUnlock()
 	rv, ok := s.serviceProviders[serviceProviderID]
-	if !ok {
+	mdqBaseURL := s.mdqBaseURL
+	mdqTrustedCerts := s.mdqTrustedCerts
+	s.idpConfigMu.RUnlock()
+	if ok {
+		return rv, nil
+	}
+	if mdqBaseURL == "" {
 		return nil, os.ErrNotExist
 	}
-	return rv, nil
+
+	descriptor, err := s.lookupMDQ(r.Context(), mdqBaseURL, mdqTrustedCerts, serviceProviderID)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return descriptor, nil
 }
 
 // HandleListServices handles the `GET /services/` request and responds with a JSON formatted list
@@ -40,7 +68,7 @@ func (s *Server) GetServiceProvider(r *http.Request, serviceProviderID string) (
 func (s *Server) HandleListServices(ctx *gin.Context) {
 	services, err := s.Store.List(ctx, "/services/")
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to list services", "err", err)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -56,30 +84,62 @@ func (s *Server) HandleGetService(ctx *gin.Context) {
 	service := Service{}
 	err := s.Store.Get(ctx, fmt.Sprintf("/services/%s", ctx.Param("id")), &service)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to get service", "err", err, "sp_entity_id", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if service.MetadataSource != nil {
+		if !service.LastRefreshed.IsZero() {
+			ctx.Writer.Header().Set("X-Samlidp-Last-Refreshed", service.LastRefreshed.Format(time.RFC3339))
+		}
+		if service.LastRefreshError != "" {
+			ctx.Writer.Header().Set("X-Samlidp-Last-Refresh-Error", service.LastRefreshError)
+		}
+	}
 	xml.NewEncoder(ctx.Writer).Encode(service.Metadata)
 }
 
-// HandlePutService handles the `PATCH /shortcuts/:id` request. It accepts the XML-formatted
-// service metadata in the request body and stores it.
+// HandlePutService handles the `PATCH /services/:id` request. With a plain
+// body it accepts XML-formatted service metadata and stores it, as before.
+// With "Content-Type: application/json" it instead accepts a JSON-encoded
+// MetadataSource, fetches and verifies the document it names, and stores the
+// service with that MetadataSource attached so metadataRefresher keeps it
+// current from then on — this is how a service is registered by URL instead
+// of by pasting its metadata.
 func (s *Server) HandlePutService(ctx *gin.Context) {
 	service := Service{}
 
-	metadata, err := getSPMetadata(ctx.Request.Body)
-	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
-		http.Error(ctx.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
+	if isJSONRequest(ctx.Request) {
+		source := MetadataSource{}
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&source); err != nil {
+			s.loggerFrom(ctx).Error("failed to decode metadata source", "err", err, "sp_entity_id", ctx.Param("id"))
+			http.Error(ctx.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		descriptor, err := fetchAndVerifyMetadata(ctx, &source)
+		if err != nil {
+			s.loggerFrom(ctx).Error("failed to fetch service provider metadata", "err", err, "sp_entity_id", ctx.Param("id"), "url", source.URL)
+			http.Error(ctx.Writer, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
 
-	service.Metadata = *metadata
+		service.MetadataSource = &source
+		service.Metadata = *descriptor
+		service.LastRefreshed = timeNow()
+	} else {
+		metadata, err := getSPMetadata(ctx.Request.Body)
+		if err != nil {
+			s.loggerFrom(ctx).Error("failed to parse service provider metadata", "err", err, "sp_entity_id", ctx.Param("id"))
+			http.Error(ctx.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		service.Metadata = *metadata
+	}
 
-	err = s.Store.Put(ctx, fmt.Sprintf("/services/%s", ctx.Param("id")), &service)
+	err := s.Store.Put(ctx, fmt.Sprintf("/services/%s", ctx.Param("id")), &service)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to store service", "err", err, "sp_entity_id", service.Metadata.EntityID)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -91,18 +151,25 @@ func (s *Server) HandlePutService(ctx *gin.Context) {
 	ctx.Writer.WriteHeader(http.StatusNoContent)
 }
 
+// isJSONRequest reports whether r's Content-Type is application/json,
+// ignoring any parameters such as a charset.
+func isJSONRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/json")
+}
+
 // HandleDeleteService handles the `DELETE /services/:id` request.
 func (s *Server) HandleDeleteService(ctx *gin.Context) {
 	service := Service{}
 	err := s.Store.Get(ctx, fmt.Sprintf("/services/%s", ctx.Param("id")), &service)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to get service", "err", err, "sp_entity_id", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	if err := s.Store.Delete(ctx, fmt.Sprintf("/services/%s", ctx.Param("id"))); err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to delete service", "err", err, "sp_entity_id", service.Metadata.EntityID)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -117,20 +184,60 @@ func (s *Server) HandleDeleteService(ctx *gin.Context) {
 // initializeServices reads all the stored services and initializes the underlying
 // identity provider to accept them.
 func (s *Server) initializeServices() error {
-	ctx := context.TODO()
+	return s.resyncServices(context.TODO())
+}
+
+// resyncServices rebuilds s.serviceProviders from every Service currently in
+// the Store, then atomically swaps it in under idpConfigMu. It is called once
+// at startup by initializeServices and again on every change notification
+// delivered by watchServices, so that a peer's HandlePutService or
+// HandleDeleteService is picked up even when this process isn't the one that
+// served the request.
+func (s *Server) resyncServices(ctx context.Context) error {
 	serviceNames, err := s.Store.List(ctx, "/services/")
 	if err != nil {
 		return err
 	}
+	serviceProviders := make(map[string]*saml.EntityDescriptor, len(serviceNames))
+	mdqBaseURL := ""
+	var mdqTrustedCerts []string
 	for _, serviceName := range serviceNames {
 		service := Service{}
 		if err := s.Store.Get(ctx, fmt.Sprintf("/services/%s", serviceName), &service); err != nil {
 			return err
 		}
-
-		s.idpConfigMu.Lock()
-		s.serviceProviders[service.Metadata.EntityID] = &service.Metadata
-		s.idpConfigMu.Unlock()
+		serviceProviders[service.Metadata.EntityID] = &service.Metadata
+		if service.MetadataSource != nil && service.MetadataSource.MDQBaseURL != "" {
+			mdqBaseURL = service.MetadataSource.MDQBaseURL
+			mdqTrustedCerts = service.MetadataSource.TrustedSigningCerts
+		}
 	}
+
+	s.idpConfigMu.Lock()
+	s.serviceProviders = serviceProviders
+	s.mdqBaseURL = mdqBaseURL
+	s.mdqTrustedCerts = mdqTrustedCerts
+	s.idpConfigMu.Unlock()
 	return nil
 }
+
+// watchServices listens for change notifications on the /services/ prefix, if
+// the configured Store implements Watcher, and resyncs s.serviceProviders on
+// every event. It returns once ctx is canceled or the Store doesn't support
+// watching, so it is meant to be run in its own goroutine.
+func (s *Server) watchServices(ctx context.Context) {
+	watcher, ok := s.Store.(Watcher)
+	if !ok {
+		return
+	}
+	events, err := watcher.Watch(ctx, "/services/")
+	if err != nil {
+		s.logger.Error("failed to watch services for changes", "err", err)
+		return
+	}
+	for range events {
+		if err := s.resyncServices(ctx); err != nil {
+			s.logger.Error("failed to resync services after watch event", "err", err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package samlidp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/vine-io/saml"
+)
+
+// sessionCookieName is the name of the cookie that carries the ID of the
+// authenticated browser session.
+const sessionCookieName = "token"
+
+// sessionMaxAge bounds how long a browser session is trusted before the
+// user must present credentials again.
+const sessionMaxAge = time.Hour
+
+// Session represents an established security context between a browser and
+// this IDP. It is persisted under /sessions/ in the Store, which lets
+// HandleGetSession, HandleDeleteSession and the SLO handlers in slo.go all
+// resolve it long after the *saml.Session handed to a particular SP has been
+// forgotten.
+type Session struct {
+	ID       string   `json:"id"`
+	NameID   string   `json:"name_id"`
+	UserName string   `json:"user_name"`
+	Groups   []string `json:"groups,omitempty"`
+
+	CreateTime time.Time `json:"create_time"`
+
+	// ExpiresAt is when the session stops being valid outright, regardless of
+	// activity. Zero means it never expires on its own.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// LastActivityAt is bumped by GetSession every time the session is used
+	// to satisfy an authentication request, and compared against IdleTimeout
+	// to decide whether the session has gone idle.
+	LastActivityAt time.Time `json:"last_activity_at"`
+
+	// MaxLifetime is the session's total lifetime from CreateTime, used to
+	// compute ExpiresAt. Zero means no lifetime limit.
+	MaxLifetime time.Duration `json:"max_lifetime,omitempty"`
+
+	// IdleTimeout is how long the session may go without activity before
+	// GetSession treats it as expired. Zero means no idle timeout.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	// Revoked marks a session terminated ahead of its natural expiry, by
+	// HandleRevokeSession.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// expired reports whether session should no longer be honored, either
+// because it was explicitly revoked, its total lifetime has elapsed, or it
+// has been idle for longer than IdleTimeout.
+func (session *Session) expired(now time.Time) bool {
+	if session.Revoked {
+		return true
+	}
+	if !session.ExpiresAt.IsZero() && !now.Before(session.ExpiresAt) {
+		return true
+	}
+	if session.IdleTimeout > 0 && now.Sub(session.LastActivityAt) > session.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<html>
+<head><title>Log In</title></head>
+<body>
+	<form method="post" action="?">
+		<label>User Name <input type="text" name="user" /></label>
+		<label>Password <input type="password" name="password" /></label>
+		<input type="submit" value="Log In" />
+	</form>
+</body>
+</html>`))
+
+// HandleListSessions handles the `GET /sessions/` request and responds with a JSON formatted
+// list of session names.
+func (s *Server) HandleListSessions(ctx *gin.Context) {
+	sessions, err := s.Store.List(ctx, "/sessions/")
+	if err != nil {
+		s.loggerFrom(ctx).Error("failed to list sessions", "err", err)
+		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(ctx.Writer).Encode(struct {
+		Sessions []string `json:"sessions"`
+	}{Sessions: sessions})
+}
+
+// HandleGetSession handles the `GET /sessions/:id` request and responds with the session
+// object in JSON format.
+func (s *Server) HandleGetSession(ctx *gin.Context) {
+	session := Session{}
+	err := s.Store.Get(ctx, fmt.Sprintf("/sessions/%s", ctx.Param("id")), &session)
+	if err != nil {
+		s.loggerFrom(ctx).Error("failed to get session", "err", err, "session_id", ctx.Param("id"))
+		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(ctx.Writer).Encode(session)
+}
+
+// HandleDeleteSession handles the `DELETE /sessions/:id` request.
+func (s *Server) HandleDeleteSession(ctx *gin.Context) {
+	if err := s.Store.Delete(ctx, fmt.Sprintf("/sessions/%s", ctx.Param("id"))); err != nil {
+		s.loggerFrom(ctx).Error("failed to delete session", "err", err, "session_id", ctx.Param("id"))
+		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevokeSession handles the `POST /sessions/:id/revoke` request. It marks
+// the named session revoked, then terminates it the same way SLO does: fanning
+// out a LogoutRequest to every SP that participated in it before deleting the
+// session and its participant records.
+func (s *Server) HandleRevokeSession(ctx *gin.Context) {
+	key := fmt.Sprintf("/sessions/%s", ctx.Param("id"))
+	session := Session{}
+	if err := s.Store.Get(ctx, key, &session); err != nil {
+		s.loggerFrom(ctx).Error("failed to get session to revoke", "err", err, "session_id", ctx.Param("id"))
+		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	session.Revoked = true
+	if err := s.Store.Put(ctx, key, &session); err != nil {
+		s.loggerFrom(ctx).Error("failed to mark session revoked", "err", err, "session_id", session.ID)
+		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	s.terminateSession(ctx, session.ID, "")
+	ctx.Writer.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLogin handles the `/login` endpoint. If the request carries a valid session
+// cookie then GetSession will already have satisfied the authentication request, so
+// this only runs when no session exists yet: it renders a credential form on GET and
+// validates credentials on POST, establishing a new Session and setting the cookie.
+func (s *Server) HandleLogin(ctx *gin.Context) {
+	s.handleLogin(ctx.Writer, ctx.Request)
+}
+
+// handleLogin is the plain net/http implementation behind HandleLogin. It is
+// factored out so that GetSession, which is called by saml.IdentityProvider with a
+// bare http.ResponseWriter and *http.Request, can re-enter the login flow without
+// going through gin.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		loginTemplate.Execute(w, struct{}{})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	userName := r.PostForm.Get("user")
+	password := r.PostForm.Get("password")
+
+	user := User{}
+	if err := s.Store.Get(r.Context(), fmt.Sprintf("/users/%s", userName), &user); err != nil {
+		s.logger.Error("failed to get user for login", "err", err, "user", userName)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(password)) != nil {
+		s.logger.Warn("login failed: bad credentials", "user", userName)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	session, err := s.newSession(r.Context(), user)
+	if err != nil {
+		s.logger.Error("failed to create session", "err", err, "user", userName)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		MaxAge:   int(cookieMaxAge(session).Seconds()),
+		HttpOnly: true,
+		Path:     "/",
+	})
+}
+
+// cookieMaxAge derives the session cookie's MaxAge from the same
+// lifetime/idle settings newSession applied to session, so the browser
+// doesn't drop the cookie before the server-side session expires (or keep it
+// around long after). MaxLifetime bounds the cookie first, since it bounds
+// the session outright; IdleTimeout is the fallback since the session stays
+// valid only as long as it keeps being used within that window anyway. When
+// neither is configured the session never expires on its own, so the cookie
+// falls back to sessionMaxAge rather than living forever.
+func cookieMaxAge(session *Session) time.Duration {
+	switch {
+	case session.MaxLifetime > 0:
+		return session.MaxLifetime
+	case session.IdleTimeout > 0:
+		return session.IdleTimeout
+	default:
+		return sessionMaxAge
+	}
+}
+
+// newSession creates and persists a Session record for user and returns it,
+// applying user's SessionLifetime/IdleTimeout overrides or, absent those,
+// the server's DefaultSessionLifetime/DefaultIdleTimeout.
+func (s *Server) newSession(ctx context.Context, user User) (*Session, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := s.defaultSessionLifetime
+	if user.SessionLifetime != nil {
+		lifetime = *user.SessionLifetime
+	}
+	idleTimeout := s.defaultIdleTimeout
+	if user.IdleTimeout != nil {
+		idleTimeout = *user.IdleTimeout
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:             id,
+		NameID:         user.Name,
+		UserName:       user.Name,
+		Groups:         user.Groups,
+		CreateTime:     now,
+		LastActivityAt: now,
+		MaxLifetime:    lifetime,
+		IdleTimeout:    idleTimeout,
+	}
+	if lifetime > 0 {
+		session.ExpiresAt = now.Add(lifetime)
+	}
+	if err := s.Store.Put(ctx, fmt.Sprintf("/sessions/%s", session.ID), session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetSession implements saml.SessionProvider. It is invoked by IDP.ServeSSO and
+// IDP.ServeIDPInitiated to resolve (or establish) the browser session behind an
+// authentication request, and to hand back the *saml.Session used to populate the
+// resulting assertion. When an assertion is issued on behalf of a session, it records
+// a SessionParticipant so the SLO handlers in slo.go know which SPs to notify later.
+// A session that has expired, gone idle, or been revoked is treated the same as no
+// session at all, sending the caller back through the login flow.
+func (s *Server) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		s.handleLogin(w, r)
+		return nil
+	}
+
+	key := fmt.Sprintf("/sessions/%s", cookie.Value)
+	session := Session{}
+	if err := s.Store.Get(r.Context(), key, &session); err != nil {
+		s.handleLogin(w, r)
+		return nil
+	}
+
+	now := time.Now()
+	if session.expired(now) {
+		s.logger.Info("rejecting expired or revoked session", "session_id", session.ID, "user", session.UserName)
+		s.Store.Delete(r.Context(), key)
+		s.handleLogin(w, r)
+		return nil
+	}
+
+	session.LastActivityAt = now
+	if err := s.Store.Put(r.Context(), key, &session); err != nil {
+		s.logger.Error("failed to bump session activity", "err", err, "session_id", session.ID)
+	}
+
+	samlSession := &saml.Session{
+		ID:         session.ID,
+		NameID:     session.NameID,
+		CreateTime: session.CreateTime,
+		Index:      session.ID,
+	}
+
+	if err := s.recordParticipant(r.Context(), session.ID, req.ServiceProviderMetadata.EntityID, session.NameID, samlSession.Index); err != nil {
+		s.logger.Error("failed to record session participant", "err", err, "session_id", session.ID, "sp_entity_id", req.ServiceProviderMetadata.EntityID)
+	}
+
+	return samlSession
+}
+
+// sessionJanitor periodically scans /sessions/ and deletes every session
+// that has expired, gone idle, or been revoked, so that stale sessions (and
+// their participant records) don't accumulate in the Store between logins.
+// A random jitter is added to each tick to avoid every server in a cluster
+// scanning the Store at the same instant.
+func (s *Server) sessionJanitor(ctx context.Context) {
+	const interval = 5 * time.Minute
+	for {
+		jitter := time.Duration(mrand.Int63n(int64(interval / 2)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval + jitter):
+		}
+		s.sweepExpiredSessions(ctx)
+	}
+}
+
+// sweepExpiredSessions deletes every session in the Store that Session.expired
+// considers stale, along with its participant records. Unlike
+// HandleRevokeSession, it does not notify participating SPs: a session that
+// merely reached the end of its natural lifetime needs no front-channel
+// logout, since the assertions it backed have their own, shorter, lifetimes.
+func (s *Server) sweepExpiredSessions(ctx context.Context) {
+	ids, err := s.Store.List(ctx, "/sessions/")
+	if err != nil {
+		s.logger.Error("failed to list sessions for janitor sweep", "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		session := Session{}
+		if err := s.Store.Get(ctx, fmt.Sprintf("/sessions/%s", id), &session); err != nil {
+			continue
+		}
+		if !session.expired(now) {
+			continue
+		}
+
+		participants, err := s.logoutParticipants(ctx, session.ID)
+		if err != nil {
+			s.logger.Error("failed to list participants for expired session", "err", err, "session_id", session.ID)
+		}
+		for _, participant := range participants {
+			s.Store.Delete(ctx, fmt.Sprintf("/sessions/%s/participants/%s", session.ID, url.QueryEscape(participant.EntityID)))
+		}
+		if err := s.Store.Delete(ctx, fmt.Sprintf("/sessions/%s", session.ID)); err != nil {
+			s.logger.Error("failed to delete expired session", "err", err, "session_id", session.ID)
+		}
+	}
+}
+
+// randomID returns a URL-safe random identifier suitable for session and
+// participant IDs.
+func randomID() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
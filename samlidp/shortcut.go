@@ -32,8 +32,9 @@ type Shortcut struct {
 // HandleListShortcuts handles the `GET /shortcuts/` request and responds with a JSON formatted list
 // of shortcut names.
 func (s *Server) HandleListShortcuts(ctx *gin.Context) {
-	shortcuts, err := s.Store.List("/shortcuts/")
+	shortcuts, err := s.Store.List(ctx, "/shortcuts/")
 	if err != nil {
+		s.loggerFrom(ctx).Error("failed to list shortcuts", "err", err)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -47,8 +48,9 @@ func (s *Server) HandleListShortcuts(ctx *gin.Context) {
 // object in JSON format.
 func (s *Server) HandleGetShortcut(ctx *gin.Context) {
 	shortcut := Shortcut{}
-	err := s.Store.Get(fmt.Sprintf("/shortcuts/%s", ctx.Param("id")), &shortcut)
+	err := s.Store.Get(ctx, fmt.Sprintf("/shortcuts/%s", ctx.Param("id")), &shortcut)
 	if err != nil {
+		s.loggerFrom(ctx).Error("failed to get shortcut", "err", err, "shortcut", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -60,13 +62,15 @@ func (s *Server) HandleGetShortcut(ctx *gin.Context) {
 func (s *Server) HandlePutShortcut(ctx *gin.Context) {
 	shortcut := Shortcut{}
 	if err := json.NewDecoder(ctx.Request.Body).Decode(&shortcut); err != nil {
+		s.loggerFrom(ctx).Error("failed to decode shortcut", "err", err, "shortcut", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 	shortcut.Name = ctx.Param("id")
 
-	err := s.Store.Put(fmt.Sprintf("/shortcuts/%s", ctx.Param("id")), &shortcut)
+	err := s.Store.Put(ctx, fmt.Sprintf("/shortcuts/%s", ctx.Param("id")), &shortcut)
 	if err != nil {
+		s.loggerFrom(ctx).Error("failed to store shortcut", "err", err, "shortcut", shortcut.Name)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -75,8 +79,9 @@ func (s *Server) HandlePutShortcut(ctx *gin.Context) {
 
 // HandleDeleteShortcut handles the `DELETE /shortcuts/:id` request.
 func (s *Server) HandleDeleteShortcut(ctx *gin.Context) {
-	err := s.Store.Delete(fmt.Sprintf("/shortcuts/%s", ctx.Param("id")))
+	err := s.Store.Delete(ctx, fmt.Sprintf("/shortcuts/%s", ctx.Param("id")))
 	if err != nil {
+		s.loggerFrom(ctx).Error("failed to delete shortcut", "err", err, "shortcut", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -89,8 +94,8 @@ func (s *Server) HandleDeleteShortcut(ctx *gin.Context) {
 func (s *Server) HandleIDPInitiated(ctx *gin.Context) {
 	shortcutName := ctx.Param("shortcut")
 	shortcut := Shortcut{}
-	if err := s.Store.Get(fmt.Sprintf("/shortcuts/%s", shortcutName), &shortcut); err != nil {
-		s.logger.Printf("ERROR: %s", err)
+	if err := s.Store.Get(ctx, fmt.Sprintf("/shortcuts/%s", shortcutName), &shortcut); err != nil {
+		s.loggerFrom(ctx).Error("failed to get shortcut", "err", err, "shortcut", shortcutName)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,132 @@
+package samlidp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signingCert generates a throwaway self-signed RSA certificate and key pair
+// for exercising signature verification without any external fixtures.
+func signingCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "samlidp-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %s", err)
+	}
+	return key, cert
+}
+
+// signedRedirectQuery builds the raw query string an HTTP-Redirect-bound
+// LogoutRequest would carry, signing it with key per the detached
+// query-string scheme verifySignedRedirectQuery checks.
+func signedRedirectQuery(t *testing.T, key *rsa.PrivateKey, sigAlg string, hash crypto.Hash, message, relayState string) string {
+	t.Helper()
+
+	signedContent := "SAMLRequest=" + url.QueryEscape(message)
+	if relayState != "" {
+		signedContent += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	signedContent += "&SigAlg=" + url.QueryEscape(sigAlg)
+
+	hasher := hash.New()
+	hasher.Write([]byte(signedContent))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, hasher.Sum(nil))
+	if err != nil {
+		t.Fatalf("rsa.SignPKCS1v15: %s", err)
+	}
+
+	return signedContent + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+}
+
+func redirectRequest(rawQuery string) *http.Request {
+	return &http.Request{URL: &url.URL{RawQuery: rawQuery}}
+}
+
+func TestVerifySignedRedirectQuery(t *testing.T) {
+	key, cert := signingCert(t)
+	certs := []*x509.Certificate{cert}
+
+	t.Run("valid signature is accepted", func(t *testing.T) {
+		rawQuery := signedRedirectQuery(t, key, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256", crypto.SHA256, "<LogoutRequest/>", "")
+		if err := verifySignedRedirectQuery(redirectRequest(rawQuery), "SAMLRequest", certs); err != nil {
+			t.Fatalf("verifySignedRedirectQuery: %s", err)
+		}
+	})
+
+	t.Run("valid signature with RelayState is accepted", func(t *testing.T) {
+		rawQuery := signedRedirectQuery(t, key, "http://www.w3.org/2000/09/xmldsig#rsa-sha1", crypto.SHA1, "<LogoutRequest/>", "/post-logout")
+		if err := verifySignedRedirectQuery(redirectRequest(rawQuery), "SAMLRequest", certs); err != nil {
+			t.Fatalf("verifySignedRedirectQuery: %s", err)
+		}
+	})
+
+	t.Run("tampered message is rejected", func(t *testing.T) {
+		rawQuery := signedRedirectQuery(t, key, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256", crypto.SHA256, "<LogoutRequest/>", "")
+		tampered := strings.Replace(rawQuery, "SAMLRequest="+url.QueryEscape("<LogoutRequest/>"), "SAMLRequest="+url.QueryEscape(`<LogoutRequest tampered="true"/>`), 1)
+		if err := verifySignedRedirectQuery(redirectRequest(tampered), "SAMLRequest", certs); err == nil {
+			t.Fatal("verifySignedRedirectQuery accepted a tampered message")
+		}
+	})
+
+	t.Run("wrong certificate is rejected", func(t *testing.T) {
+		_, otherCert := signingCert(t)
+		rawQuery := signedRedirectQuery(t, key, "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256", crypto.SHA256, "<LogoutRequest/>", "")
+		if err := verifySignedRedirectQuery(redirectRequest(rawQuery), "SAMLRequest", []*x509.Certificate{otherCert}); err == nil {
+			t.Fatal("verifySignedRedirectQuery accepted a signature from an untrusted certificate")
+		}
+	})
+
+	t.Run("missing Signature is rejected", func(t *testing.T) {
+		rawQuery := "SAMLRequest=" + url.QueryEscape("<LogoutRequest/>") + "&SigAlg=" + url.QueryEscape("http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+		if err := verifySignedRedirectQuery(redirectRequest(rawQuery), "SAMLRequest", certs); err == nil {
+			t.Fatal("verifySignedRedirectQuery accepted a request with no Signature")
+		}
+	})
+
+	t.Run("unsupported SigAlg is rejected", func(t *testing.T) {
+		rawQuery := "SAMLRequest=" + url.QueryEscape("<LogoutRequest/>") +
+			"&SigAlg=" + url.QueryEscape("http://example.com/not-an-algorithm") +
+			"&Signature=" + url.QueryEscape("AAAA")
+		if err := verifySignedRedirectQuery(redirectRequest(rawQuery), "SAMLRequest", certs); err == nil {
+			t.Fatal("verifySignedRedirectQuery accepted an unsupported SigAlg")
+		}
+	})
+}
+
+func TestRawQueryParam(t *testing.T) {
+	rawQuery := "SAMLRequest=abc%3D%3D&RelayState=foo&SigAlg=bar"
+
+	if v, ok := rawQueryParam(rawQuery, "SAMLRequest"); !ok || v != "abc%3D%3D" {
+		t.Fatalf("rawQueryParam(SAMLRequest) = %q, %v", v, ok)
+	}
+	if v, ok := rawQueryParam(rawQuery, "RelayState"); !ok || v != "foo" {
+		t.Fatalf("rawQueryParam(RelayState) = %q, %v", v, ok)
+	}
+	if _, ok := rawQueryParam(rawQuery, "Missing"); ok {
+		t.Fatal("rawQueryParam(Missing) reported present")
+	}
+}
@@ -24,3 +24,30 @@ type Store interface {
 	// then List("a") would produce []string{"a", "b"}
 	List(ctx context.Context, prefix string) ([]string, error)
 }
+
+// EventType describes the kind of change a Watcher observed.
+type EventType int
+
+const (
+	// EventPut indicates the key was created or overwritten; Event.Value
+	// holds the new raw value.
+	EventPut EventType = iota
+	// EventDelete indicates the key was removed; Event.Value is empty.
+	EventDelete
+)
+
+// Event describes a single change observed by a Watcher.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+}
+
+// Watcher is an optional capability a Store may implement to deliver
+// change notifications for keys under prefix, so that callers caching
+// data read from the store (such as Server.serviceProviders) can stay
+// current across a cluster instead of assuming they are the only writer.
+// The returned channel is closed when ctx is canceled.
+type Watcher interface {
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
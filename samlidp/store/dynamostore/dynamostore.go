@@ -0,0 +1,122 @@
+// Package dynamostore implements samlidp.Store on top of Amazon DynamoDB,
+// for deployments that want a managed, multi-region-capable backend instead
+// of operating their own etcd or PostgreSQL cluster.
+package dynamostore
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/vine-io/saml/samlidp"
+)
+
+// keyAttr and valueAttr are the item attributes a Store reads and writes.
+// The table's partition key must be keyAttr, a string.
+const (
+	keyAttr   = "key"
+	valueAttr = "value"
+)
+
+// Store is a samlidp.Store backed by a single DynamoDB table.
+type Store struct {
+	Client *dynamodb.Client
+	Table  string
+}
+
+// New returns a Store that reads and writes through client, against the
+// named table.
+func New(client *dynamodb.Client, table string) *Store {
+	return &Store{Client: client, Table: table}
+}
+
+// Get fetches the data stored in `key` and unmarshals it into `value`. It
+// returns samlidp.ErrNotFound if the key does not exist.
+func (s *Store) Get(ctx context.Context, key string, value interface{}) error {
+	out, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			keyAttr: &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if out.Item == nil {
+		return samlidp.ErrNotFound
+	}
+	data, ok := out.Item[valueAttr].(*types.AttributeValueMemberS)
+	if !ok {
+		return samlidp.ErrNotFound
+	}
+	return json.Unmarshal([]byte(data.Value), value)
+}
+
+// Put marshals `value` as JSON and stores it in `key`.
+func (s *Store) Put(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Table),
+		Item: map[string]types.AttributeValue{
+			keyAttr:   &types.AttributeValueMemberS{Value: key},
+			valueAttr: &types.AttributeValueMemberS{Value: string(data)},
+		},
+	})
+	return err
+}
+
+// Delete removes `key`. Deleting a key that does not exist is not an error.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			keyAttr: &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	return err
+}
+
+// List returns all the keys that start with `prefix`, with the prefix
+// stripped from each returned value. It scans the table with a
+// begins_with filter, since DynamoDB has no native prefix index on an
+// arbitrary partition key.
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	filter := expression.Name(keyAttr).BeginsWith(prefix)
+	projection := expression.NamesList(expression.Name(keyAttr))
+	expr, err := expression.NewBuilder().WithFilter(filter).WithProjection(projection).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(s.Table),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+	paginator := dynamodb.NewScanPaginator(s.Client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			key, ok := item[keyAttr].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			keys = append(keys, strings.TrimPrefix(key.Value, prefix))
+		}
+	}
+	return keys, nil
+}
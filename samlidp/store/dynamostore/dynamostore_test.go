@@ -0,0 +1,58 @@
+package dynamostore
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/vine-io/saml/samlidp"
+	"github.com/vine-io/saml/samlidp/store/storetest"
+)
+
+// TestStore runs the shared conformance suite against a real DynamoDB
+// endpoint (AWS or dynamodb-local). Set SAMLIDP_DYNAMODB_ENDPOINT to run it;
+// it's skipped otherwise since this package has no embedded DynamoDB to
+// start.
+func TestStore(t *testing.T) {
+	endpoint := os.Getenv("SAMLIDP_DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("SAMLIDP_DYNAMODB_ENDPOINT not set")
+	}
+
+	storetest.Run(t, func(t *testing.T) (samlidp.Store, func()) {
+		ctx := context.Background()
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			t.Fatalf("config.LoadDefaultConfig: %s", err)
+		}
+		client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+		})
+
+		table := "samlidp-test-" + t.Name()
+		_, err = client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName: aws.String(table),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String(keyAttr), AttributeType: types.ScalarAttributeTypeS},
+			},
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String(keyAttr), KeyType: types.KeyTypeHash},
+			},
+			BillingMode: types.BillingModePayPerRequest,
+		})
+		if err != nil {
+			t.Fatalf("CreateTable: %s", err)
+		}
+
+		store := New(client, table)
+		cleanup := func() {
+			client.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+		}
+		return store, cleanup
+	})
+}
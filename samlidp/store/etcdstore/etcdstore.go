@@ -0,0 +1,110 @@
+// Package etcdstore implements samlidp.Store on top of etcd, so that an IDP
+// deployment can share its services, users, sessions and shortcuts across a
+// cluster of samlidp.Server processes instead of keeping them in memory.
+package etcdstore
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/vine-io/saml/samlidp"
+)
+
+// Store is a samlidp.Store backed by an etcd cluster. All keys written by a
+// Store are placed under Prefix, so a single cluster can be shared by
+// multiple unrelated applications.
+type Store struct {
+	Client *clientv3.Client
+	Prefix string
+}
+
+// New returns a Store that reads and writes through client, namespacing every
+// key under prefix (for example "/samlidp/").
+func New(client *clientv3.Client, prefix string) *Store {
+	return &Store{Client: client, Prefix: prefix}
+}
+
+func (s *Store) fullKey(key string) string {
+	return s.Prefix + key
+}
+
+// Get fetches the data stored in `key` and unmarshals it into `value`. It
+// returns samlidp.ErrNotFound if the key does not exist.
+func (s *Store) Get(ctx context.Context, key string, value interface{}) error {
+	resp, err := s.Client.Get(ctx, s.fullKey(key))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return samlidp.ErrNotFound
+	}
+	return json.Unmarshal(resp.Kvs[0].Value, value)
+}
+
+// Put marshals `value` as JSON and stores it in `key`.
+func (s *Store) Put(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.Put(ctx, s.fullKey(key), string(data))
+	return err
+}
+
+// Delete removes `key`. Deleting a key that does not exist is not an error.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.Delete(ctx, s.fullKey(key))
+	return err
+}
+
+// List returns all the keys that start with `prefix`, with both s.Prefix and
+// prefix stripped from each returned value.
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	resp, err := s.Client.Get(ctx, s.fullKey(prefix), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		full := string(kv.Key)
+		keys = append(keys, strings.TrimPrefix(full, s.fullKey(prefix)))
+	}
+	return keys, nil
+}
+
+// Watch implements samlidp.Watcher, delivering an Event for every etcd PUT or
+// DELETE observed under prefix from the current revision onward. The
+// returned channel is closed when ctx is canceled or the underlying etcd
+// watch terminates.
+func (s *Store) Watch(ctx context.Context, prefix string) (<-chan samlidp.Event, error) {
+	watchChan := s.Client.Watch(ctx, s.fullKey(prefix), clientv3.WithPrefix())
+	events := make(chan samlidp.Event)
+
+	go func() {
+		defer close(events)
+		for resp := range watchChan {
+			for _, change := range resp.Events {
+				event := samlidp.Event{
+					Key: strings.TrimPrefix(string(change.Kv.Key), s.fullKey(prefix)),
+				}
+				switch change.Type {
+				case clientv3.EventTypePut:
+					event.Type = samlidp.EventPut
+					event.Value = change.Kv.Value
+				case clientv3.EventTypeDelete:
+					event.Type = samlidp.EventDelete
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
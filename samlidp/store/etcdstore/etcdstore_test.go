@@ -0,0 +1,37 @@
+package etcdstore
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/vine-io/saml/samlidp"
+	"github.com/vine-io/saml/samlidp/store/storetest"
+)
+
+// TestStore runs the shared conformance suite against a real etcd cluster.
+// Set SAMLIDP_ETCD_ENDPOINTS (comma-separated) to run it; it's skipped
+// otherwise since this package has no embedded etcd server to start.
+func TestStore(t *testing.T) {
+	endpoint := os.Getenv("SAMLIDP_ETCD_ENDPOINTS")
+	if endpoint == "" {
+		t.Skip("SAMLIDP_ETCD_ENDPOINTS not set")
+	}
+
+	storetest.Run(t, func(t *testing.T) (samlidp.Store, func()) {
+		client, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(endpoint, ",")})
+		if err != nil {
+			t.Fatalf("clientv3.New: %s", err)
+		}
+		prefix := "/samlidp-test-" + t.Name() + "/"
+		store := New(client, prefix)
+		cleanup := func() {
+			client.Delete(context.Background(), prefix, clientv3.WithPrefix())
+			client.Close()
+		}
+		return store, cleanup
+	})
+}
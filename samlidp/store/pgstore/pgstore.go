@@ -0,0 +1,97 @@
+// Package pgstore implements samlidp.Store on top of PostgreSQL, for
+// deployments that already run Postgres and want durable storage without
+// operating a separate etcd cluster.
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/vine-io/saml/samlidp"
+)
+
+// schema is the table pgstore reads and writes; New runs it when constructing
+// a Store, so the table is created if it does not already exist.
+const schema = `
+CREATE TABLE IF NOT EXISTS samlidp_store (
+	key        TEXT PRIMARY KEY,
+	value      JSONB NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// Store is a samlidp.Store backed by a PostgreSQL table.
+type Store struct {
+	DB *sql.DB
+}
+
+// New returns a Store that reads and writes through db, creating the
+// backing table if it does not already exist.
+func New(ctx context.Context, db *sql.DB) (*Store, error) {
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		return nil, err
+	}
+	return &Store{DB: db}, nil
+}
+
+// Get fetches the data stored in `key` and unmarshals it into `value`. It
+// returns samlidp.ErrNotFound if the key does not exist.
+func (s *Store) Get(ctx context.Context, key string, value interface{}) error {
+	var data []byte
+	err := s.DB.QueryRowContext(ctx, `SELECT value FROM samlidp_store WHERE key = $1`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return samlidp.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// Put marshals `value` as JSON and upserts it into `key`.
+func (s *Store) Put(ctx context.Context, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO samlidp_store (key, value, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`,
+		key, data)
+	return err
+}
+
+// Delete removes `key`. Deleting a key that does not exist is not an error.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM samlidp_store WHERE key = $1`, key)
+	return err
+}
+
+// List returns all the keys that start with `prefix`, with the prefix
+// stripped from each returned value.
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT key FROM samlidp_store WHERE key LIKE $1`, escapeLike(prefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+	}
+	return keys, rows.Err()
+}
+
+// escapeLike escapes the LIKE metacharacters in s so a key's literal prefix
+// can be matched safely, independent of the values the caller passes in.
+func escapeLike(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(s)
+}
@@ -0,0 +1,39 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"github.com/vine-io/saml/samlidp"
+	"github.com/vine-io/saml/samlidp/store/storetest"
+)
+
+// TestStore runs the shared conformance suite against a real PostgreSQL
+// database. Set SAMLIDP_POSTGRES_DSN to run it; it's skipped otherwise since
+// this package has no embedded Postgres server to start.
+func TestStore(t *testing.T) {
+	dsn := os.Getenv("SAMLIDP_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SAMLIDP_POSTGRES_DSN not set")
+	}
+
+	storetest.Run(t, func(t *testing.T) (samlidp.Store, func()) {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatalf("sql.Open: %s", err)
+		}
+		store, err := New(context.Background(), db)
+		if err != nil {
+			t.Fatalf("New: %s", err)
+		}
+		cleanup := func() {
+			db.Exec(`DELETE FROM samlidp_store`)
+			db.Close()
+		}
+		return store, cleanup
+	})
+}
@@ -0,0 +1,161 @@
+// Package storetest provides a conformance test suite that every
+// samlidp.Store backend can run against its own factory, so the in-memory,
+// etcd, PostgreSQL and DynamoDB implementations are all held to the same
+// behavioral contract.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vine-io/saml/samlidp"
+)
+
+// Factory builds a fresh, empty Store for a single test and returns a
+// cleanup function that releases any resources (temporary tables, etcd
+// namespaces, ...) the Store allocated. Run calls cleanup when the test
+// finishes.
+type Factory func(t *testing.T) (store samlidp.Store, cleanup func())
+
+// record is the value type used by every test in this suite; it is
+// representative of the structs (Service, User, Session, ...) that samlidp
+// actually stores.
+type record struct {
+	Name string
+	Data string
+}
+
+// Run exercises factory's Store against prefix semantics, not-found
+// behavior, concurrent writers and large-value round-trips. Call it from a
+// backend's own *_test.go as storetest.Run(t, newTestStore).
+func Run(t *testing.T, factory Factory) {
+	t.Run("GetPutDelete", func(t *testing.T) { testGetPutDelete(t, factory) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, factory) })
+	t.Run("ListPrefix", func(t *testing.T) { testListPrefix(t, factory) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, factory) })
+	t.Run("LargeValueRoundTrip", func(t *testing.T) { testLargeValueRoundTrip(t, factory) })
+}
+
+func testGetPutDelete(t *testing.T, factory Factory) {
+	store, cleanup := factory(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	want := record{Name: "alice", Data: "hello"}
+	if err := store.Put(ctx, "/users/alice", &want); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	got := record{}
+	if err := store.Get(ctx, "/users/alice", &got); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if got != want {
+		t.Fatalf("Get returned %+v, want %+v", got, want)
+	}
+
+	if err := store.Delete(ctx, "/users/alice"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if err := store.Get(ctx, "/users/alice", &got); !errors.Is(err, samlidp.ErrNotFound) {
+		t.Fatalf("Get after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func testNotFound(t *testing.T, factory Factory) {
+	store, cleanup := factory(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	got := record{}
+	if err := store.Get(ctx, "/users/nobody", &got); !errors.Is(err, samlidp.ErrNotFound) {
+		t.Fatalf("Get of missing key = %v, want ErrNotFound", err)
+	}
+}
+
+func testListPrefix(t *testing.T, factory Factory) {
+	store, cleanup := factory(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	keys := []string{"/services/a", "/services/b", "/users/a"}
+	for _, key := range keys {
+		if err := store.Put(ctx, key, &record{Name: key}); err != nil {
+			t.Fatalf("Put(%s): %s", key, err)
+		}
+	}
+
+	got, err := store.List(ctx, "/services/")
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	want := []string{"a", "b"}
+	if !equalSet(got, want) {
+		t.Fatalf("List(/services/) = %v, want %v", got, want)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, factory Factory) {
+	store, cleanup := factory(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const writers = 16
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			key := "/sessions/shared"
+			if err := store.Put(ctx, key, &record{Name: "writer", Data: strconv.Itoa(i)}); err != nil {
+				t.Errorf("concurrent Put: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got := record{}
+	if err := store.Get(ctx, "/sessions/shared", &got); err != nil {
+		t.Fatalf("Get after concurrent writes: %s", err)
+	}
+}
+
+func testLargeValueRoundTrip(t *testing.T, factory Factory) {
+	store, cleanup := factory(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := strings.Repeat("x", 1<<20) // 1 MiB
+	want := record{Name: "large", Data: data}
+	if err := store.Put(ctx, "/services/large", &want); err != nil {
+		t.Fatalf("Put large value: %s", err)
+	}
+
+	got := record{}
+	if err := store.Get(ctx, "/services/large", &got); err != nil {
+		t.Fatalf("Get large value: %s", err)
+	}
+	if got != want {
+		t.Fatalf("large value round-trip mismatch (got %d bytes, want %d)", len(got.Data), len(want.Data))
+	}
+}
+
+func equalSet(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, k := range got {
+		seen[k] = true
+	}
+	for _, k := range want {
+		if !seen[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
@@ -21,6 +22,14 @@ type User struct {
 	Surname           string   `json:"surname,omitempty"`
 	GivenName         string   `json:"given_name,omitempty"`
 	ScopedAffiliation string   `json:"scoped_affiliation,omitempty"`
+
+	// SessionLifetime overrides Options.DefaultSessionLifetime for sessions
+	// created for this user. Nil means use the server default.
+	SessionLifetime *time.Duration `json:"session_lifetime,omitempty"`
+
+	// IdleTimeout overrides Options.DefaultIdleTimeout for sessions created
+	// for this user. Nil means use the server default.
+	IdleTimeout *time.Duration `json:"idle_timeout,omitempty"`
 }
 
 // HandleListUsers handles the `GET /users/` request and responds with a JSON formatted list
@@ -28,7 +37,7 @@ type User struct {
 func (s *Server) HandleListUsers(ctx *gin.Context) {
 	users, err := s.Store.List(ctx, "/users/")
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to list users", "err", err)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -44,7 +53,7 @@ func (s *Server) HandleGetUser(ctx *gin.Context) {
 	user := User{}
 	err := s.Store.Get(ctx, fmt.Sprintf("/users/%s", ctx.Param("id")), &user)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to get user", "err", err, "user", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -59,7 +68,7 @@ func (s *Server) HandleGetUser(ctx *gin.Context) {
 func (s *Server) HandlePutUser(ctx *gin.Context) {
 	user := User{}
 	if err := json.NewDecoder(ctx.Request.Body).Decode(&user); err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to decode user", "err", err, "user", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
@@ -69,7 +78,7 @@ func (s *Server) HandlePutUser(ctx *gin.Context) {
 		var err error
 		user.HashedPassword, err = bcrypt.GenerateFromPassword([]byte(*user.PlaintextPassword), bcrypt.DefaultCost)
 		if err != nil {
-			s.logger.Printf("ERROR: %s", err)
+			s.loggerFrom(ctx).Error("failed to hash password", "err", err, "user", user.Name)
 			http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -82,7 +91,7 @@ func (s *Server) HandlePutUser(ctx *gin.Context) {
 		case err == ErrNotFound:
 			// nop
 		default:
-			s.logger.Printf("ERROR: %s", err)
+			s.loggerFrom(ctx).Error("failed to get existing user", "err", err, "user", user.Name)
 			http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -91,7 +100,7 @@ func (s *Server) HandlePutUser(ctx *gin.Context) {
 
 	err := s.Store.Put(ctx, fmt.Sprintf("/users/%s", ctx.Param("id")), &user)
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to store user", "err", err, "user", user.Name)
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -102,7 +111,7 @@ func (s *Server) HandlePutUser(ctx *gin.Context) {
 func (s *Server) HandleDeleteUser(ctx *gin.Context) {
 	err := s.Store.Delete(ctx, fmt.Sprintf("/users/%s", ctx.Param("id")))
 	if err != nil {
-		s.logger.Printf("ERROR: %s", err)
+		s.loggerFrom(ctx).Error("failed to delete user", "err", err, "user", ctx.Param("id"))
 		http.Error(ctx.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}